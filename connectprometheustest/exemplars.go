@@ -0,0 +1,68 @@
+package connectprometheustest
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Exemplars gathers the metric family with the passed name and returns the exemplars
+// attached to its counters and histogram buckets, for metrics matching all passed labels.
+// For example, passing prometheus.Labels{"method": "Bar"} returns the exemplars of all
+// series of that method. It returns an error if the metric family isn't gathered.
+func Exemplars(g prometheus.Gatherer, name string, labels prometheus.Labels) ([]*dto.Exemplar, error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+
+		var exemplars []*dto.Exemplar
+		for _, m := range mf.GetMetric() {
+			if !matchLabels(m, labels) {
+				continue
+			}
+			if e := m.GetCounter().GetExemplar(); e != nil {
+				exemplars = append(exemplars, e)
+			}
+			for _, b := range m.GetHistogram().GetBucket() {
+				if e := b.GetExemplar(); e != nil {
+					exemplars = append(exemplars, e)
+				}
+			}
+		}
+		return exemplars, nil
+	}
+
+	return nil, fmt.Errorf("metric %s not gathered", name)
+}
+
+// ExemplarLabel returns the value of the exemplar's label with the passed name,
+// for example a trace ID, or an empty string if the exemplar doesn't have the label.
+func ExemplarLabel(e *dto.Exemplar, name string) string {
+	for _, l := range e.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// matchLabels returns true if the metric has all the labels with the same values.
+func matchLabels(m *dto.Metric, labels prometheus.Labels) bool {
+	values := make(map[string]string, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		values[l.GetName()] = l.GetValue()
+	}
+	for name, value := range labels {
+		if values[name] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package connectprometheustest
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestExemplars(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "test_requests_total",
+		Help: "Test counter.",
+	}, []string{"method"})
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "test_handling_seconds",
+		Help:    "Test histogram.",
+		Buckets: []float64{0.1, 1},
+	}, []string{"method"})
+	reg.MustRegister(counter, histogram)
+
+	counter.WithLabelValues("Bar").(prometheus.ExemplarAdder).AddWithExemplar(1, prometheus.Labels{"trace_id": "bar"})
+	counter.WithLabelValues("Baz").(prometheus.ExemplarAdder).AddWithExemplar(1, prometheus.Labels{"trace_id": "baz"})
+	histogram.WithLabelValues("Bar").(prometheus.ExemplarObserver).ObserveWithExemplar(0.5, prometheus.Labels{"trace_id": "bar"})
+
+	for _, name := range []string{"test_requests_total", "test_handling_seconds"} {
+		exemplars, err := Exemplars(reg, name, prometheus.Labels{"method": "Bar"})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(exemplars) != 1 {
+			t.Fatalf("%s: got %d exemplars, want 1", name, len(exemplars))
+		}
+		if got := ExemplarLabel(exemplars[0], "trace_id"); got != "bar" {
+			t.Errorf("%s: got trace_id %q, want bar", name, got)
+		}
+		if got := ExemplarLabel(exemplars[0], "span_id"); got != "" {
+			t.Errorf("%s: got span_id %q, want none", name, got)
+		}
+	}
+
+	if _, err := Exemplars(reg, "test_missing_total", nil); err == nil {
+		t.Error("expected error for a metric that isn't gathered")
+	}
+}
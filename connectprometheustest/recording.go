@@ -0,0 +1,83 @@
+// Package connectprometheustest provides helpers for testing code
+// instrumented with the connectprometheus interceptor.
+package connectprometheustest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bufbuild/connect-go"
+	connectprometheus "github.com/polarsignals/connect-go-prometheus"
+)
+
+// Call is a request recorded by a RecordingInterceptor.
+type Call struct {
+	Procedure  string
+	StreamType connect.StreamType
+	IsClient   bool
+	// Code is the code of the request as recorded by connectprometheus, for example ok or not_found.
+	Code string
+}
+
+// RecordingInterceptor is a connect interceptor that records the calls
+// it observes in memory, instead of registering prometheus metrics.
+// It's safe for concurrent use.
+type RecordingInterceptor struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+// NewRecordingInterceptor creates a new RecordingInterceptor without any recorded calls.
+func NewRecordingInterceptor() *RecordingInterceptor {
+	return &RecordingInterceptor{}
+}
+
+// Calls returns a copy of the calls recorded so far, in the order they completed.
+func (i *RecordingInterceptor) Calls() []Call {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	calls := make([]Call, len(i.calls))
+	copy(calls, i.calls)
+	return calls
+}
+
+// Reset removes all recorded calls.
+func (i *RecordingInterceptor) Reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.calls = nil
+}
+
+func (i *RecordingInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		resp, err := next(ctx, req)
+		i.record(req.Spec(), err)
+		return resp, err
+	}
+}
+
+func (i *RecordingInterceptor) WrapStreamingClient(handle connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return handle
+}
+
+func (i *RecordingInterceptor) WrapStreamingHandler(handle connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		err := handle(ctx, conn)
+		i.record(conn.Spec(), err)
+		return err
+	}
+}
+
+func (i *RecordingInterceptor) record(spec connect.Spec, err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.calls = append(i.calls, Call{
+		Procedure:  spec.Procedure,
+		StreamType: spec.StreamType,
+		IsClient:   spec.IsClient,
+		Code:       connectprometheus.Code(err),
+	})
+}
@@ -0,0 +1,52 @@
+package connectprometheustest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const testProcedure = "/test.v1.TestService/Unary"
+
+func TestRecordingInterceptor(t *testing.T) {
+	interceptor := NewRecordingInterceptor()
+
+	mux := http.NewServeMux()
+	mux.Handle(testProcedure, connect.NewUnaryHandler(
+		testProcedure,
+		func(ctx context.Context, req *connect.Request[emptypb.Empty]) (*connect.Response[emptypb.Empty], error) {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("not found"))
+		},
+		connect.WithInterceptors(interceptor),
+	))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := connect.NewClient[emptypb.Empty, emptypb.Empty](
+		server.Client(),
+		server.URL+testProcedure,
+		connect.WithInterceptors(interceptor),
+	)
+	if _, err := client.CallUnary(context.Background(), connect.NewRequest(&emptypb.Empty{})); connect.CodeOf(err) != connect.CodeNotFound {
+		t.Fatalf("got error %v, want not_found", err)
+	}
+
+	want := []Call{
+		{Procedure: testProcedure, StreamType: connect.StreamTypeUnary, IsClient: false, Code: "not_found"},
+		{Procedure: testProcedure, StreamType: connect.StreamTypeUnary, IsClient: true, Code: "not_found"},
+	}
+	if got := interceptor.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got calls %+v, want %+v", got, want)
+	}
+
+	interceptor.Reset()
+	if got := interceptor.Calls(); len(got) != 0 {
+		t.Errorf("got calls %+v after reset, want none", got)
+	}
+}
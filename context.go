@@ -0,0 +1,60 @@
+package connectprometheus
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+type outcomeKey struct{}
+
+// SetOutcome sets the outcome label recorded for the server request of ctx,
+// for example validation_failed or quota_exceeded, independent of its code.
+// It does nothing unless the request is recorded by an interceptor with WithOutcomeLabel.
+func SetOutcome(ctx context.Context, outcome string) {
+	if v, ok := ctx.Value(outcomeKey{}).(*atomic.Value); ok {
+		v.Store(outcome)
+	}
+}
+
+// withOutcome returns a context allowing handlers to set an outcome with SetOutcome.
+func withOutcome(ctx context.Context) context.Context {
+	return context.WithValue(ctx, outcomeKey{}, &atomic.Value{})
+}
+
+// outcome returns the outcome set for a call, or an empty string if none is set.
+func outcome(c *call) string {
+	if v, ok := c.ctx.Value(outcomeKey{}).(*atomic.Value); ok {
+		if outcome, ok := v.Load().(string); ok {
+			return outcome
+		}
+	}
+	return ""
+}
+
+type handlerDoneKey struct{}
+
+// StampHandlerDone marks the time the handler of the server request of ctx finished
+// its work, before its response is serialized. It does nothing unless the request
+// is recorded by an interceptor with WithHandlerTimeHistogram.
+func StampHandlerDone(ctx context.Context) {
+	if v, ok := ctx.Value(handlerDoneKey{}).(*atomic.Int64); ok {
+		v.Store(time.Now().UnixNano())
+	}
+}
+
+// withHandlerDone returns a context allowing handlers to call StampHandlerDone.
+func withHandlerDone(ctx context.Context) context.Context {
+	return context.WithValue(ctx, handlerDoneKey{}, &atomic.Int64{})
+}
+
+// handlerDone returns the time stamped with StampHandlerDone,
+// or false if the handler didn't stamp it.
+func handlerDone(ctx context.Context) (time.Time, bool) {
+	if v, ok := ctx.Value(handlerDoneKey{}).(*atomic.Int64); ok {
+		if stamp := v.Load(); stamp != 0 {
+			return time.Unix(0, stamp), true
+		}
+	}
+	return time.Time{}, false
+}
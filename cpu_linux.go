@@ -0,0 +1,33 @@
+//go:build linux
+
+package connectprometheus
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+)
+
+const cpuTimeSupported = true
+
+// measureCPUTime runs f locked to the current OS thread and returns
+// the user and system CPU time the thread consumed while running f.
+// Locking keeps other goroutines off the thread, so their CPU time isn't included.
+// CPU time spent in other goroutines started by f is not included either.
+func measureCPUTime(f func()) (time.Duration, bool) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var before, after syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_THREAD, &before); err != nil {
+		f()
+		return 0, false
+	}
+	f()
+	if err := syscall.Getrusage(syscall.RUSAGE_THREAD, &after); err != nil {
+		return 0, false
+	}
+
+	used := after.Utime.Nano() - before.Utime.Nano() + after.Stime.Nano() - before.Stime.Nano()
+	return time.Duration(used), true
+}
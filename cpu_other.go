@@ -0,0 +1,15 @@
+//go:build !linux
+
+package connectprometheus
+
+import (
+	"time"
+)
+
+const cpuTimeSupported = false
+
+// measureCPUTime runs f. Measuring the CPU time is not supported on this platform.
+func measureCPUTime(f func()) (time.Duration, bool) {
+	f()
+	return 0, false
+}
@@ -2,71 +2,511 @@ package connectprometheus
 
 import (
 	"context"
+	"errors"
+	"expvar"
 	"fmt"
+	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bufbuild/connect-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
 )
 
+// Interceptor is a connect interceptor recording prometheus metrics for client and server requests.
+// It records the code returned by everything after it in the interceptor chain,
+// so it should be placed first to also record requests rejected by other interceptors.
 type Interceptor struct {
-	clientRequests *prometheus.CounterVec
-	serverRequests *prometheus.CounterVec
+	*collectors
+
+	recordClient bool
+	recordServer bool
+
+	serverDisabled atomic.Bool
+}
+
+// collectors are the metrics and config shared by Interceptors created together.
+type collectors struct {
+	config config
+
+	clientLabels []string
+	serverLabels []string
+
+	procedures sync.Map // procedure -> procedureLabels
+
+	gatherer    prometheus.Gatherer
+	metricNames map[string]struct{}
+
+	recorder Recorder
+
+	clientNoDeadline *prometheus.CounterVec
+	serverErrors     *prometheus.CounterVec
+	serverRejections *prometheus.CounterVec
+	systemRequests   *prometheus.CounterVec
+	serverWindow     *windowedCounter
+
+	serverCPUTime *prometheus.HistogramVec
+	serverHandler *prometheus.HistogramVec
+	serverTimeout *prometheus.HistogramVec
+
+	interceptorErrors *prometheus.CounterVec
+
+	clientPrelude prometheus.Histogram
+	serverPrelude prometheus.Histogram
+
+	serverMessageSizes  *prometheus.HistogramVec
+	serverErrorDetails  *prometheus.HistogramVec
+	serverSLOViolations *prometheus.CounterVec
+
+	clientExpvar *expvar.Map
+	serverExpvar *expvar.Map
+
+	serverStreamMessages        *prometheus.HistogramVec
+	serverStreamMessageInterval *prometheus.HistogramVec
+	serverStreamFirstReceive    *prometheus.HistogramVec
+	serverStreamMessageSizes    *prometheus.HistogramVec
+	serverStreamPendingSends    *prometheus.GaugeVec
+	serverStreamPendingReceives *prometheus.GaugeVec
+	serverStreamErrors          *prometheus.CounterVec
+}
+
+// NewDefaultInterceptor creates a new connect interceptor
+// that registers metrics with prometheus.DefaultRegisterer.
+func NewDefaultInterceptor(opts ...Option) *Interceptor {
+	return NewInterceptor(prometheus.DefaultRegisterer, opts...)
 }
 
 // NewInterceptor creates a new connect interceptor
 // that registers metrics with the passed prometheus.Registerer.
-func NewInterceptor(reg prometheus.Registerer) *Interceptor {
+// If the prometheus.Registerer is nil, the metrics aren't registered at all.
+func NewInterceptor(reg prometheus.Registerer, opts ...Option) *Interceptor {
+	return &Interceptor{
+		collectors:   newCollectors(reg, opts...),
+		recordClient: true,
+		recordServer: true,
+	}
+}
+
+// New creates a pair of connect interceptors sharing the same metrics and config,
+// that register metrics with the passed prometheus.Registerer.
+// The client interceptor only records client requests
+// and the server interceptor only records server requests.
+func New(reg prometheus.Registerer, opts ...Option) (client, server *Interceptor) {
+	c := newCollectors(reg, opts...)
+	return &Interceptor{collectors: c, recordClient: true}, &Interceptor{collectors: c, recordServer: true}
+}
+
+func newCollectors(reg prometheus.Registerer, opts ...Option) *collectors {
 	labelCode := "code"
+	labelDirection := "direction"
 	labelMethod := "method"
+	labelPhase := "phase"
+	labelReason := "reason"
 	labelService := "service"
 	labelType := "type"
 
-	interceptor := &Interceptor{}
+	c := &collectors{
+		metricNames: map[string]struct{}{},
+	}
+	for _, opt := range opts {
+		opt(&c.config)
+	}
+	if g, ok := reg.(prometheus.Gatherer); ok {
+		c.gatherer = g
+	}
+	if c.config.worker != "" {
+		reg = prometheus.WrapRegistererWith(prometheus.Labels{"worker": c.config.worker}, reg)
+	}
+
+	clientLabels := append([]string{labelCode, labelMethod, labelService, labelType}, c.config.labelNames(true)...)
+	serverLabels := append([]string{labelCode, labelMethod, labelService, labelType}, c.config.labelNames(false)...)
+	c.clientLabels = clientLabels
+	c.serverLabels = serverLabels
+
+	if c.config.recorder != nil {
+		c.recorder = c.config.recorder
+	} else {
+		c.recorder = c.newPrometheusRecorder(reg)
+	}
+
+	if c.config.missingDeadline {
+		c.clientNoDeadline = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: c.metricName("connect_client_requests_without_deadline", "total"),
+			Help: "Tracks the number of connect client requests sent without a deadline by method and service.",
+		}, []string{labelMethod, labelService})
+	}
+
+	if c.config.errorCounter {
+		c.serverErrors = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: c.metricName("connect_server_errors", "total"),
+			Help: "Tracks the number of failed connect server requests by code, method, service and type.",
+		}, serverLabels)
+	}
+
+	if c.config.rejectionCodes != nil {
+		c.serverRejections = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: c.metricName("connect_server_rejections", "total"),
+			Help: "Tracks the number of rejected connect server requests by code, method and service.",
+		}, []string{labelCode, labelMethod, labelService})
+	}
+
+	if c.config.window > 0 {
+		c.serverWindow = newWindowedCounter(
+			c.metricName("connect_server_requests_window", ""),
+			"Tracks the number of connect server requests within the current window by code, method, service and type.",
+			serverLabels,
+			c.config.window,
+		)
+		if reg != nil {
+			reg.MustRegister(c.serverWindow)
+		}
+	}
+
+	if c.config.systemServices {
+		c.systemRequests = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: c.metricName("connect_system_requests", "total"),
+			Help: "Tracks the number of connect server requests to gRPC reflection and health services by code, method, service and type.",
+		}, []string{labelCode, labelMethod, labelService, labelType})
+	}
+
+	c.interceptorErrors = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: c.metricName("connect_interceptor_errors", "total"),
+		Help: "Tracks the number of errors within the connect prometheus interceptor by reason.",
+	}, []string{labelReason})
+
+	if c.config.cpuTime && cpuTimeSupported {
+		c.serverCPUTime = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    c.metricName("connect_server_handling_cpu", "seconds"),
+			Help:    "Tracks the approximate CPU time of connect server requests by code, method, service and type.",
+			Buckets: c.config.durationBucketsOrDefault(),
+		}, serverLabels)
+	}
 
-	interceptor.clientRequests = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
-		Name: "connect_client_requests_total",
-		Help: "Tracks the number of connect client requests by code, method, service and type.",
-	}, []string{labelCode, labelMethod, labelService, labelType})
+	if c.config.handlerTime {
+		c.serverHandler = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    c.metricName("connect_server_handler", "seconds"),
+			Help:    "Tracks the duration of connect server handlers until they stamped their work done by code, method, service and type.",
+			Buckets: c.config.durationBucketsOrDefault(),
+		}, serverLabels)
+	}
+
+	if c.config.requestTimeout {
+		c.serverTimeout = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    c.metricName("connect_server_requested_timeout", "seconds"),
+			Help:    "Tracks the timeouts declared by clients of connect server requests by method and service.",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+		}, []string{labelMethod, labelService})
+	}
 
-	interceptor.serverRequests = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
-		Name: "connect_server_requests_total",
-		Help: "Tracks the number of connect server requests by code, method, service and type.",
-	}, []string{labelCode, labelMethod, labelService, labelType})
+	if c.config.prelude {
+		c.clientPrelude = promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    c.metricName("connect_client_prelude", "seconds"),
+			Help:    "Tracks the time spent in the interceptor before connect client requests are sent.",
+			Buckets: prometheus.ExponentialBuckets(0.000001, 4, 10),
+		})
 
-	return interceptor
+		c.serverPrelude = promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    c.metricName("connect_server_prelude", "seconds"),
+			Help:    "Tracks the time spent in the interceptor before connect server requests are handled.",
+			Buckets: prometheus.ExponentialBuckets(0.000001, 4, 10),
+		})
+	}
+
+	if c.config.combinedSizes {
+		c.serverMessageSizes = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    c.metricName("connect_server_message", "bytes"),
+			Help:    "Tracks the size of connect server request and response messages by direction, code, method, service and type.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 10),
+		}, append([]string{labelDirection}, serverLabels...))
+	}
+
+	if c.config.errorDetails {
+		c.serverErrorDetails = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    c.metricName("connect_server_error_detail", "bytes"),
+			Help:    "Tracks the size of connect server error details by code, method, service and type.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+		}, serverLabels)
+	}
+
+	if c.config.sloThresholds != nil {
+		c.serverSLOViolations = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: c.metricName("connect_server_slo_violations", "total"),
+			Help: "Tracks the number of connect server requests exceeding their latency threshold by method and service.",
+		}, []string{labelMethod, labelService})
+	}
+
+	if c.config.expvar {
+		c.clientExpvar = expvarMap("connect_client_requests_total")
+		c.serverExpvar = expvarMap("connect_server_requests_total")
+	}
+
+	if c.config.streamMetrics {
+		c.serverStreamMessages = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    c.metricName("connect_server_stream_messages_per_stream", ""),
+			Help:    "Tracks the number of request and response messages per connect server stream by direction, method, service and type.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 11),
+		}, []string{labelDirection, labelMethod, labelService, labelType})
+
+		c.serverStreamMessageInterval = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    c.metricName("connect_server_stream_message_interval", "seconds"),
+			Help:    "Tracks the interval between consecutive messages sent by connect server streams by method, service and type.",
+			Buckets: c.config.durationBucketsOrDefault(),
+		}, []string{labelMethod, labelService, labelType})
+
+		c.serverStreamFirstReceive = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    c.metricName("connect_server_stream_first_receive", "seconds"),
+			Help:    "Tracks the time from opening client and bidi connect server streams until receiving the first message by method, service and type.",
+			Buckets: c.config.durationBucketsOrDefault(),
+		}, []string{labelMethod, labelService, labelType})
+
+		c.serverStreamErrors = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: c.metricName("connect_server_stream_errors", "total"),
+			Help: "Tracks the number of failed connect server streams by code, method, phase, service and type.",
+		}, []string{labelCode, labelMethod, labelPhase, labelService, labelType})
+
+		c.serverStreamMessageSizes = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    c.metricName("connect_server_stream_message_size", "bytes"),
+			Help:    "Tracks the size of connect server stream request and response messages by direction, method and service.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 10),
+		}, []string{labelDirection, labelMethod, labelService})
+
+		c.serverStreamPendingSends = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: c.metricName("connect_server_stream_pending_sends", ""),
+			Help: "Tracks the number of in-progress sends on connect server streams by method, service and type.",
+		}, []string{labelMethod, labelService, labelType})
+
+		c.serverStreamPendingReceives = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: c.metricName("connect_server_stream_pending_receives", ""),
+			Help: "Tracks the number of in-progress receives on connect server streams by method, service and type.",
+		}, []string{labelMethod, labelService, labelType})
+	}
+
+	return c
+}
+
+// streamType returns the type label value for the connect.StreamType.
+// With WithStrictStreamType, unknown stream types are counted as interceptor errors.
+func (i *Interceptor) streamType(t connect.StreamType) string {
+	typ := StreamType(t)
+	if typ == "unknown" && i.config.strictStream {
+		i.interceptorErrors.WithLabelValues("unknown_stream_type").Inc()
+	}
+	return typ
+}
+
+// metricName returns the name of a metric with its unit and the configured suffix,
+// remembering it as one of the interceptor's metrics.
+func (c *collectors) metricName(name, unit string) string {
+	name = c.config.metricName(name, unit)
+	c.metricNames[name] = struct{}{}
+	return name
+}
+
+// DurationBuckets returns the buckets in seconds of the request duration histograms,
+// or nil if they aren't enabled.
+func (i *Interceptor) DurationBuckets() []float64 {
+	if i.config.durationBuckets == nil {
+		return nil
+	}
+	return append([]float64(nil), i.config.durationBuckets...)
+}
+
+// Snapshot gathers the current values of the interceptor's metrics,
+// for example to expose them on a debug endpoint.
+// It returns an error if the prometheus.Registerer passed to NewInterceptor
+// isn't also a prometheus.Gatherer, like *prometheus.Registry.
+func (i *Interceptor) Snapshot() ([]*dto.MetricFamily, error) {
+	if i.gatherer == nil {
+		return nil, errors.New("connectprometheus: registerer is not a prometheus.Gatherer")
+	}
+
+	mfs, err := i.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := make([]*dto.MetricFamily, 0, len(i.metricNames))
+	for _, mf := range mfs {
+		if _, ok := i.metricNames[mf.GetName()]; ok {
+			snapshot = append(snapshot, mf)
+		}
+	}
+	return snapshot, nil
+}
+
+// instrumentedKey is the context key of the Interceptor recording a request.
+// Client and server requests are keyed separately, so client requests
+// made while handling a server request are still recorded.
+type instrumentedKey struct {
+	client bool
+}
+
+// SetServerEnabled enables or disables recording server metrics at runtime.
+// While disabled, server requests are still handled but not recorded.
+// Server metrics are enabled by default. It's safe to call concurrently with requests.
+func (i *Interceptor) SetServerEnabled(enabled bool) {
+	i.serverDisabled.Store(!enabled)
 }
 
 func (i *Interceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
 	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		entered := time.Now()
+
 		spec := req.Spec()
-		procedure := strings.Split(spec.Procedure, "/")
-		if len(procedure) != 3 {
-			return nil, connect.NewError(
-				connect.CodeInternal,
-				fmt.Errorf("procedure in prometheus interceptor malformed: %s", spec.Procedure),
-			)
+		spec.Procedure = i.config.trimProcedure(spec.Procedure)
+		if spec.IsClient && !i.recordClient || !spec.IsClient && (!i.recordServer || i.serverDisabled.Load()) {
+			return next(ctx, req)
+		}
+
+		// Skip recording if this interceptor is already recording the request,
+		// as it was added to the interceptor chain multiple times.
+		key := instrumentedKey{client: spec.IsClient}
+		if ctx.Value(key) == i {
+			return next(ctx, req)
+		}
+		ctx = context.WithValue(ctx, key, i)
+
+		if !spec.IsClient && i.config.outcomeLabel {
+			ctx = withOutcome(ctx)
+		}
+		if !spec.IsClient && i.serverHandler != nil {
+			ctx = withHandlerDone(ctx)
+		}
+
+		service, method, err := i.procedure(spec.Procedure)
+		if err != nil {
+			return nil, err
+		}
+
+		// Requests to system services are only recorded in the system requests counter.
+		system := i.systemProcedure(spec)
+
+		if !spec.IsClient && !system && i.serverTimeout != nil {
+			if timeout, ok := requestedTimeout(req.Header()); ok {
+				i.serverTimeout.WithLabelValues(method, service).Observe(timeout.Seconds())
+			}
+		}
+
+		if spec.IsClient && i.clientNoDeadline != nil {
+			if _, ok := ctx.Deadline(); !ok {
+				i.clientNoDeadline.WithLabelValues(method, service).Inc()
+			}
+		}
+
+		var (
+			resp    connect.AnyResponse
+			cpuTime time.Duration
+			cpuOK   bool
+		)
+
+		start := time.Now()
+		if spec.IsClient && i.clientPrelude != nil {
+			i.clientPrelude.Observe(start.Sub(entered).Seconds())
+		} else if !spec.IsClient && !system && i.serverPrelude != nil {
+			i.serverPrelude.Observe(start.Sub(entered).Seconds())
 		}
-		service, method := procedure[1], procedure[2]
 
 		// Execute the actual request.
-		resp, err := next(ctx, req)
+		if !spec.IsClient && !system && i.serverCPUTime != nil {
+			cpuTime, cpuOK = measureCPUTime(func() {
+				resp, err = next(ctx, req)
+			})
+		} else {
+			resp, err = next(ctx, req)
+		}
 
-		if spec.IsClient {
-			i.clientRequests.WithLabelValues(
-				code(err),
+		elapsed := time.Since(start)
+		duration := elapsed.Seconds()
+
+		if system {
+			i.systemRequests.WithLabelValues(
+				Code(err),
 				method,
 				service,
-				streamType(spec.StreamType),
+				i.streamType(spec.StreamType),
 			).Inc()
+			return resp, err
+		}
+
+		if i.config.recordPredicate != nil && !i.config.recordPredicate(err) {
+			return resp, err
+		}
+
+		labels := []string{
+			Code(err),
+			method,
+			service,
+			i.streamType(spec.StreamType),
+		}
+		if len(i.config.labels) > 0 {
+			c := &call{
+				ctx:      ctx,
+				spec:     spec,
+				peer:     req.Peer(),
+				header:   req.Header(),
+				duration: elapsed,
+			}
+			if resp != nil {
+				c.trailer = resp.Trailer()
+			}
+			labels = i.config.appendLabelValues(labels, c)
+		}
+
+		requestLabels := Labels{Names: i.serverLabels, Values: labels}
+		if spec.IsClient {
+			requestLabels.Names = i.clientLabels
+			i.recorder.IncRequest(spec, requestLabels)
+			if i.clientExpvar != nil {
+				i.clientExpvar.Add(spec.Procedure+":"+labels[0], 1)
+			}
 		} else {
-			i.serverRequests.WithLabelValues(
-				code(err),
-				method,
-				service,
-				streamType(spec.StreamType),
-			).Inc()
+			i.recordServerRequest(spec, labels, err)
+		}
+		i.recorder.ObserveDuration(spec, requestLabels, elapsed)
+
+		if i.config.observers != nil {
+			observerLabels := make(prometheus.Labels, len(requestLabels.Names))
+			for n, name := range requestLabels.Names {
+				observerLabels[name] = labels[n]
+			}
+			i.config.observers(observerLabels).ObserveDuration(duration)
+		}
+
+		if !spec.IsClient {
+			if i.serverHandler != nil {
+				if done, ok := handlerDone(ctx); ok {
+					i.serverHandler.WithLabelValues(labels...).Observe(done.Sub(start).Seconds())
+				}
+			}
+			if cpuOK {
+				i.serverCPUTime.WithLabelValues(labels...).Observe(cpuTime.Seconds())
+			}
+			if i.serverMessageSizes != nil {
+				if size, ok := i.messageSize(req.Any()); ok {
+					i.serverMessageSizes.WithLabelValues(append([]string{"request"}, labels...)...).Observe(float64(size))
+				}
+				if resp != nil {
+					if size, ok := i.messageSize(resp.Any()); ok {
+						i.serverMessageSizes.WithLabelValues(append([]string{"response"}, labels...)...).Observe(float64(size))
+					}
+				}
+			}
+			if i.serverErrorDetails != nil {
+				if size, ok := errorDetailSize(err); ok {
+					i.serverErrorDetails.WithLabelValues(labels...).Observe(float64(size))
+				}
+			}
+			if i.serverSLOViolations != nil {
+				if threshold, ok := i.config.sloThreshold(spec.Procedure); ok && elapsed > threshold {
+					i.serverSLOViolations.WithLabelValues(method, service).Inc()
+				}
+			}
 		}
 
 		return resp, err
@@ -79,21 +519,267 @@ func (i *Interceptor) WrapStreamingClient(handle connect.StreamingClientFunc) co
 }
 
 func (i *Interceptor) WrapStreamingHandler(handle connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
-	// nop for now
-	return handle
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		if !i.recordServer || i.serverDisabled.Load() {
+			return handle(ctx, conn)
+		}
+
+		key := instrumentedKey{}
+		if ctx.Value(key) == i {
+			return handle(ctx, conn)
+		}
+
+		// Streams with procedures the labels can't be parsed from
+		// are handled without recording them, instead of failing them.
+		spec := conn.Spec()
+		spec.Procedure = i.config.trimProcedure(spec.Procedure)
+		service, method, err := i.procedure(spec.Procedure)
+		if err != nil {
+			return handle(ctx, conn)
+		}
+
+		ctx = context.WithValue(ctx, key, i)
+		if i.config.outcomeLabel {
+			ctx = withOutcome(ctx)
+		}
+
+		typ := i.streamType(spec.StreamType)
+
+		system := i.systemProcedure(spec)
+
+		var wrapped *handlerConn
+		if i.config.streamMetrics && !system {
+			wrapped = &handlerConn{
+				StreamingHandlerConn: conn,
+				opened:               time.Now(),
+				sendInterval:         i.serverStreamMessageInterval.WithLabelValues(method, service, typ),
+				pendingSends:         i.serverStreamPendingSends.WithLabelValues(method, service, typ),
+				pendingReceives:      i.serverStreamPendingReceives.WithLabelValues(method, service, typ),
+				messageSize:          i.messageSize,
+				sentSize:             i.serverStreamMessageSizes.WithLabelValues("response", method, service),
+				receivedSize:         i.serverStreamMessageSizes.WithLabelValues("request", method, service),
+			}
+			// The first receive of server streams is the single request,
+			// so it's only observed for streams of client messages.
+			if spec.StreamType == connect.StreamTypeClient || spec.StreamType == connect.StreamTypeBidi {
+				wrapped.firstReceive = i.serverStreamFirstReceive.WithLabelValues(method, service, typ)
+			}
+			conn = wrapped
+		}
+
+		start := time.Now()
+
+		// Execute the actual stream handler.
+		err = handle(ctx, conn)
+
+		if system {
+			i.systemRequests.WithLabelValues(Code(err), method, service, typ).Inc()
+			return err
+		}
+
+		if i.config.recordPredicate != nil && !i.config.recordPredicate(err) {
+			return err
+		}
+
+		labels := []string{
+			Code(err),
+			method,
+			service,
+			typ,
+		}
+		if len(i.config.labels) > 0 {
+			labels = i.config.appendLabelValues(labels, &call{
+				ctx:      ctx,
+				spec:     spec,
+				peer:     conn.Peer(),
+				header:   conn.RequestHeader(),
+				trailer:  conn.ResponseTrailer(),
+				duration: time.Since(start),
+			})
+		}
+		i.recordServerRequest(spec, labels, err)
+
+		if wrapped == nil {
+			return err
+		}
+
+		i.serverStreamMessages.WithLabelValues("response", method, service, typ).Observe(float64(wrapped.sent))
+		i.serverStreamMessages.WithLabelValues("request", method, service, typ).Observe(float64(wrapped.received))
+
+		if err != nil {
+			// The stream failed at open if no message flowed before the error.
+			phase := "streaming"
+			if wrapped.sent == 0 && wrapped.received == 0 {
+				phase = "open"
+			}
+			i.serverStreamErrors.WithLabelValues(Code(err), method, phase, service, typ).Inc()
+		}
+
+		return err
+	}
+}
+
+// recordServerRequest records the metrics shared by unary and streaming server requests
+// with the label values of the request, so they all count the same requests.
+func (i *Interceptor) recordServerRequest(spec connect.Spec, labels []string, err error) {
+	i.recorder.IncRequest(spec, Labels{Names: i.serverLabels, Values: labels})
+
+	if i.serverWindow != nil {
+		i.serverWindow.Inc(labels...)
+	}
+	if err != nil && i.serverErrors != nil {
+		i.serverErrors.WithLabelValues(labels...).Inc()
+	}
+	if _, ok := i.config.rejectionCodes[labels[0]]; ok {
+		i.serverRejections.WithLabelValues(labels[0], labels[1], labels[2]).Inc()
+	}
+	if i.serverExpvar != nil {
+		i.serverExpvar.Add(spec.Procedure+":"+labels[0], 1)
+	}
+}
+
+// expvarMap returns the expvar.Map published with the name,
+// publishing a new one if none exists yet. This allows multiple
+// interceptors to share the same expvar maps.
+func expvarMap(name string) *expvar.Map {
+	if m, ok := expvar.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	return expvar.NewMap(name)
+}
+
+// messageSize returns the serialized size of a message.
+// It returns false if the message isn't a protobuf message
+// or computing its size panics, so a malformed message can't
+// crash the request. Panics are counted as interceptor errors.
+func (i *Interceptor) messageSize(msg any) (size int, ok bool) {
+	m, ok := msg.(proto.Message)
+	if !ok {
+		return 0, false
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			i.interceptorErrors.WithLabelValues("message_size").Inc()
+			size, ok = 0, false
+		}
+	}()
+
+	return proto.Size(m), true
+}
+
+// requestedTimeout returns the timeout declared by the Connect-Timeout-Ms header.
+// It returns false if the header is absent or invalid.
+func requestedTimeout(header http.Header) (time.Duration, bool) {
+	value := header.Get("Connect-Timeout-Ms")
+	if value == "" {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms < 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// errorDetailSize returns the serialized size of the details of a connect error.
+// It returns false if the error isn't a connect error or has no details.
+func errorDetailSize(err error) (int, bool) {
+	var connectErr *connect.Error
+	if !errors.As(err, &connectErr) {
+		return 0, false
+	}
+	details := connectErr.Details()
+	if len(details) == 0 {
+		return 0, false
+	}
+
+	size := 0
+	for _, detail := range details {
+		size += len(detail.Bytes())
+	}
+	return size, true
+}
+
+// procedureLabels are the service and method label values of a procedure.
+type procedureLabels struct {
+	service string
+	method  string
+}
+
+// procedure returns the service and method label values of a procedure.
+// The label values are computed once per procedure and cached afterwards,
+// to avoid allocations on every request.
+func (i *Interceptor) procedure(procedure string) (service, method string, err error) {
+	if cached, ok := i.procedures.Load(procedure); ok {
+		pl := cached.(procedureLabels)
+		return pl.service, pl.method, nil
+	}
+
+	service, method, err = splitProcedure(procedure)
+	if err != nil {
+		return "", "", err
+	}
+
+	if _, ok := i.config.allowedMethods[method]; i.config.allowedMethods != nil && !ok {
+		method = "other"
+	} else {
+		method = i.config.labelCase.apply(method)
+	}
+	service = i.config.labelCase.apply(service)
+
+	i.procedures.Store(procedure, procedureLabels{service: service, method: method})
+	return service, method, nil
+}
+
+// systemProcedure returns true if the server request is recorded
+// in the system requests counter instead of the other metrics.
+func (i *Interceptor) systemProcedure(spec connect.Spec) bool {
+	return !spec.IsClient && i.systemRequests != nil && isSystemProcedure(spec.Procedure)
+}
+
+// isSystemProcedure returns true for procedures of the gRPC reflection and health services.
+func isSystemProcedure(procedure string) bool {
+	return strings.HasPrefix(procedure, "/grpc.reflection.") || strings.HasPrefix(procedure, "/grpc.health.")
 }
 
-// code returns the code based on an error.
+// splitProcedure returns the service and method of a procedure,
+// for example "/acme.foo.v1.FooService/Bar".
+func splitProcedure(procedure string) (service, method string, err error) {
+	parts := strings.Split(procedure, "/")
+	if len(parts) != 3 {
+		return "", "", connect.NewError(
+			connect.CodeInternal,
+			fmt.Errorf("procedure in prometheus interceptor malformed: %s", procedure),
+		)
+	}
+	return parts[1], parts[2], nil
+}
+
+// Code returns the code label value based on an error.
 // If error is nil the code is ok.
-func code(err error) string {
+// Context errors not wrapped in a connect error are mapped
+// to deadline_exceeded and canceled, instead of unknown.
+func Code(err error) string {
 	if err == nil {
 		return "ok"
 	}
+
+	var connectErr *connect.Error
+	if !errors.As(err, &connectErr) {
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			return connect.CodeDeadlineExceeded.String()
+		case errors.Is(err, context.Canceled):
+			return connect.CodeCanceled.String()
+		}
+	}
 	return connect.CodeOf(err).String()
 }
 
-// streamType returns a string for the connect.StreamType.
-func streamType(t connect.StreamType) string {
+// StreamType returns the type label value for the connect.StreamType.
+// Stream types unknown to this package return unknown.
+func StreamType(t connect.StreamType) string {
 	switch t {
 	case connect.StreamTypeUnary:
 		return "unary"
@@ -104,6 +790,6 @@ func streamType(t connect.StreamType) string {
 	case connect.StreamTypeBidi:
 		return "bidi_stream"
 	default:
-		return ""
+		return "unknown"
 	}
 }
@@ -0,0 +1,580 @@
+package connectprometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	testUnaryProcedure  = "/test.v1.TestService/Unary"
+	testStreamProcedure = "/test.v1.TestService/Stream"
+)
+
+// specRequest is a connect.AnyRequest with a fixed connect.Spec,
+// to call wrapped unary funcs without a server.
+type specRequest struct {
+	connect.AnyRequest
+	spec connect.Spec
+}
+
+func newSpecRequest(procedure string) *specRequest {
+	return &specRequest{
+		AnyRequest: connect.NewRequest(&emptypb.Empty{}),
+		spec:       connect.Spec{Procedure: procedure, StreamType: connect.StreamTypeUnary},
+	}
+}
+
+func (r *specRequest) Spec() connect.Spec {
+	return r.spec
+}
+
+// specConn is a connect.StreamingHandlerConn with a fixed connect.Spec and no messages,
+// to call wrapped streaming handlers without a server.
+type specConn struct {
+	spec connect.Spec
+}
+
+func newSpecConn(procedure string) *specConn {
+	return &specConn{spec: connect.Spec{Procedure: procedure, StreamType: connect.StreamTypeBidi}}
+}
+
+func (c *specConn) Spec() connect.Spec           { return c.spec }
+func (c *specConn) Peer() connect.Peer           { return connect.Peer{} }
+func (c *specConn) Receive(any) error            { return nil }
+func (c *specConn) RequestHeader() http.Header   { return http.Header{} }
+func (c *specConn) Send(any) error               { return nil }
+func (c *specConn) ResponseHeader() http.Header  { return http.Header{} }
+func (c *specConn) ResponseTrailer() http.Header { return http.Header{} }
+
+// gatherMetrics returns the metrics named name whose labels include the passed labels.
+func gatherMetrics(t *testing.T, g prometheus.Gatherer, name string, labels map[string]string) []*dto.Metric {
+	t.Helper()
+
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+
+	var metrics []*dto.Metric
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			matched := 0
+			for _, lp := range m.GetLabel() {
+				if v, ok := labels[lp.GetName()]; ok {
+					if v != lp.GetValue() {
+						continue metrics
+					}
+					matched++
+				}
+			}
+			if matched == len(labels) {
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	return metrics
+}
+
+// counterValue returns the sum of the counters named name
+// whose labels include the passed labels.
+func counterValue(t *testing.T, g prometheus.Gatherer, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	var value float64
+	for _, m := range gatherMetrics(t, g, name, labels) {
+		value += m.GetCounter().GetValue()
+	}
+	return value
+}
+
+// sampleCount returns the sum of the sample counts of the histograms named name
+// whose labels include the passed labels.
+func sampleCount(t *testing.T, g prometheus.Gatherer, name string, labels map[string]string) uint64 {
+	t.Helper()
+
+	var count uint64
+	for _, m := range gatherMetrics(t, g, name, labels) {
+		count += m.GetHistogram().GetSampleCount()
+	}
+	return count
+}
+
+func TestSetServerEnabledConcurrently(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	i := NewInterceptor(reg)
+
+	var calls atomic.Int64
+	unary := i.WrapUnary(func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		calls.Add(1)
+		return connect.NewResponse(&emptypb.Empty{}), nil
+	})
+	stream := i.WrapStreamingHandler(func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		calls.Add(1)
+		return nil
+	})
+	req := newSpecRequest(testUnaryProcedure)
+	conn := newSpecConn(testStreamProcedure)
+	ctx := context.Background()
+
+	call := func() {
+		if _, err := unary(ctx, req); err != nil {
+			t.Errorf("unary: %v", err)
+		}
+		if err := stream(ctx, conn); err != nil {
+			t.Errorf("stream: %v", err)
+		}
+	}
+
+	const workers, iterations = 4, 1000
+
+	done := make(chan struct{})
+	var toggler sync.WaitGroup
+	toggler.Add(1)
+	go func() {
+		defer toggler.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				i.SetServerEnabled(false)
+				i.SetServerEnabled(true)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < iterations; n++ {
+				call()
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	toggler.Wait()
+
+	if got, want := calls.Load(), int64(2*workers*iterations); got != want {
+		t.Fatalf("next called %d times, want %d", got, want)
+	}
+
+	i.SetServerEnabled(false)
+	before := counterValue(t, reg, "connect_server_requests_total", nil)
+	calls.Store(0)
+	for n := 0; n < 10; n++ {
+		call()
+	}
+	if got := calls.Load(); got != 20 {
+		t.Errorf("next called %d times while disabled, want 20", got)
+	}
+	if after := counterValue(t, reg, "connect_server_requests_total", nil); after != before {
+		t.Errorf("recorded %v requests while disabled, want 0", after-before)
+	}
+
+	i.SetServerEnabled(true)
+	call()
+	if after := counterValue(t, reg, "connect_server_requests_total", nil); after != before+2 {
+		t.Errorf("recorded %v requests after enabling, want 2", after-before)
+	}
+}
+
+func TestInterceptorRecordsRejectionsOfInnerInterceptors(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	auth := connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+		return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+			return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("missing token"))
+		}
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle(testUnaryProcedure, connect.NewUnaryHandler(
+		testUnaryProcedure,
+		func(ctx context.Context, req *connect.Request[emptypb.Empty]) (*connect.Response[emptypb.Empty], error) {
+			t.Error("handler called for unauthenticated request")
+			return connect.NewResponse(&emptypb.Empty{}), nil
+		},
+		connect.WithInterceptors(NewInterceptor(reg), auth),
+	))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := connect.NewClient[emptypb.Empty, emptypb.Empty](server.Client(), server.URL+testUnaryProcedure)
+	_, err := client.CallUnary(context.Background(), connect.NewRequest(&emptypb.Empty{}))
+	if connect.CodeOf(err) != connect.CodeUnauthenticated {
+		t.Fatalf("got error %v, want unauthenticated", err)
+	}
+
+	got := counterValue(t, reg, "connect_server_requests_total", map[string]string{
+		"code":    "unauthenticated",
+		"method":  "Unary",
+		"service": "test.v1.TestService",
+		"type":    "unary",
+	})
+	if got != 1 {
+		t.Errorf("got %v unauthenticated requests, want 1", got)
+	}
+}
+
+func BenchmarkWrapUnary(b *testing.B) {
+	resp := connect.NewResponse(&emptypb.Empty{})
+	unary := NewInterceptor(prometheus.NewRegistry()).WrapUnary(func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		return resp, nil
+	})
+	req := newSpecRequest(testUnaryProcedure)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := unary(ctx, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWrapUnaryAllocations(t *testing.T) {
+	resp := connect.NewResponse(&emptypb.Empty{})
+	unary := NewInterceptor(prometheus.NewRegistry()).WrapUnary(func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		return resp, nil
+	})
+	req := newSpecRequest(testUnaryProcedure)
+	ctx := context.Background()
+
+	// With the default options a request allocates the context
+	// marking it as instrumented and the label values.
+	const budget = 2
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := unary(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > budget {
+		t.Errorf("got %v allocations per request, want at most %d", allocs, budget)
+	}
+}
+
+func TestWithUserAgentLabelNilNormalizer(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewInterceptor didn't panic for a nil normalizer")
+		}
+	}()
+	NewInterceptor(nil, WithUserAgentLabel(nil))
+}
+
+func TestStreamsCountedInSharedServerMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	i := NewInterceptor(reg,
+		WithErrorCounter(),
+		WithRejectionCodes([]connect.Code{connect.CodeResourceExhausted}),
+	)
+
+	stream := i.WrapStreamingHandler(func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		return connect.NewError(connect.CodeResourceExhausted, errors.New("too many streams"))
+	})
+	if err := stream(context.Background(), newSpecConn(testStreamProcedure)); err == nil {
+		t.Fatal("expected stream error")
+	}
+
+	labels := map[string]string{"code": "resource_exhausted", "method": "Stream"}
+	for _, name := range []string{
+		"connect_server_requests_total",
+		"connect_server_errors_total",
+		"connect_server_rejections_total",
+	} {
+		if got := counterValue(t, reg, name, labels); got != 1 {
+			t.Errorf("got %v for %s, want 1", got, name)
+		}
+	}
+}
+
+func TestSystemServiceStreams(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	i := NewInterceptor(reg, WithSystemServiceMetric(), WithStreamMetrics())
+
+	stream := i.WrapStreamingHandler(func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		return conn.Send(&emptypb.Empty{})
+	})
+	if err := stream(context.Background(), newSpecConn("/grpc.health.v1.Health/Watch")); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{"service": "grpc.health.v1.Health", "method": "Watch"}
+	if got := counterValue(t, reg, "connect_system_requests_total", labels); got != 1 {
+		t.Errorf("got %v system requests, want 1", got)
+	}
+	if got := counterValue(t, reg, "connect_server_requests_total", labels); got != 0 {
+		t.Errorf("got %v server requests, want 0", got)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if strings.HasPrefix(mf.GetName(), "connect_server_stream_") && len(mf.GetMetric()) > 0 {
+			t.Errorf("got stream metric %s for a system service", mf.GetName())
+		}
+	}
+}
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "nil", err: nil, want: "ok"},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, want: "deadline_exceeded"},
+		{name: "canceled", err: context.Canceled, want: "canceled"},
+		{name: "wrapped context error", err: fmt.Errorf("calling backend: %w", context.DeadlineExceeded), want: "deadline_exceeded"},
+		{name: "connect error", err: connect.NewError(connect.CodeNotFound, errors.New("not found")), want: "not_found"},
+		{name: "connect error wrapping context error", err: connect.NewError(connect.CodeUnavailable, context.Canceled), want: "unavailable"},
+		{name: "other error", err: errors.New("boom"), want: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Code(tt.err); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// panicConn is a specConn whose Send and Receive panic.
+type panicConn struct {
+	*specConn
+}
+
+func (c panicConn) Send(any) error    { panic("send") }
+func (c panicConn) Receive(any) error { panic("receive") }
+
+func TestStreamPendingGaugesAfterPanic(t *testing.T) {
+	i := NewInterceptor(prometheus.NewRegistry(), WithStreamMetrics())
+
+	stream := i.WrapStreamingHandler(func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		for _, f := range []func(){
+			func() { _ = conn.Send(&emptypb.Empty{}) },
+			func() { _ = conn.Receive(&emptypb.Empty{}) },
+		} {
+			func() {
+				defer func() { _ = recover() }()
+				f()
+			}()
+		}
+		return nil
+	})
+	if err := stream(context.Background(), panicConn{newSpecConn(testStreamProcedure)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, gauge := range map[string]*prometheus.GaugeVec{
+		"pending sends":    i.serverStreamPendingSends,
+		"pending receives": i.serverStreamPendingReceives,
+	} {
+		var m dto.Metric
+		if err := gauge.WithLabelValues("Stream", "test.v1.TestService", "bidi_stream").Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.GetGauge().GetValue(); got != 0 {
+			t.Errorf("got %v %s after panic, want 0", got, name)
+		}
+	}
+}
+
+func TestStreamFirstReceive(t *testing.T) {
+	tests := []struct {
+		streamType connect.StreamType
+		want       uint64
+	}{
+		{streamType: connect.StreamTypeClient, want: 1},
+		{streamType: connect.StreamTypeBidi, want: 1},
+		{streamType: connect.StreamTypeServer, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(StreamType(tt.streamType), func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			stream := NewInterceptor(reg, WithStreamMetrics()).WrapStreamingHandler(func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+				return conn.Receive(&emptypb.Empty{})
+			})
+			conn := &specConn{spec: connect.Spec{Procedure: testStreamProcedure, StreamType: tt.streamType}}
+			if err := stream(context.Background(), conn); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := sampleCount(t, reg, "connect_server_stream_first_receive_seconds", nil); got != tt.want {
+				t.Errorf("got %d first receives, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSystemServiceUnaryRequests(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	i := NewInterceptor(reg, WithSystemServiceMetric(), WithPreludeHistogram(), WithRequestedTimeoutHistogram())
+
+	unary := i.WrapUnary(func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		return connect.NewResponse(&emptypb.Empty{}), nil
+	})
+	req := newSpecRequest("/grpc.health.v1.Health/Check")
+	req.Header().Set("Connect-Timeout-Ms", "1000")
+	if _, err := unary(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := counterValue(t, reg, "connect_system_requests_total", nil); got != 1 {
+		t.Errorf("got %v system requests, want 1", got)
+	}
+	for _, name := range []string{
+		"connect_server_prelude_seconds",
+		"connect_server_requested_timeout_seconds",
+	} {
+		if got := sampleCount(t, reg, name, nil); got != 0 {
+			t.Errorf("got %d observations of %s for a system service, want 0", got, name)
+		}
+	}
+}
+
+func TestStreamErrorPhase(t *testing.T) {
+	tests := []struct {
+		name  string
+		sends int
+		want  string
+	}{
+		{name: "before send", sends: 0, want: "open"},
+		{name: "after send", sends: 1, want: "streaming"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			stream := NewInterceptor(reg, WithStreamMetrics()).WrapStreamingHandler(func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+				for n := 0; n < tt.sends; n++ {
+					if err := conn.Send(&emptypb.Empty{}); err != nil {
+						return err
+					}
+				}
+				return connect.NewError(connect.CodeUnavailable, errors.New("unavailable"))
+			})
+			if err := stream(context.Background(), newSpecConn(testStreamProcedure)); err == nil {
+				t.Fatal("expected stream error")
+			}
+
+			got := counterValue(t, reg, "connect_server_stream_errors_total", map[string]string{
+				"code":  "unavailable",
+				"phase": tt.want,
+			})
+			if got != 1 {
+				t.Errorf("got %v errors in phase %s, want 1", got, tt.want)
+			}
+			if total := counterValue(t, reg, "connect_server_stream_errors_total", nil); total != 1 {
+				t.Errorf("got %v errors in total, want 1", total)
+			}
+		})
+	}
+}
+
+func TestWindowedCounterResets(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	i := NewInterceptor(reg, WithWindowedCounter(time.Hour))
+
+	unary := i.WrapUnary(func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		return connect.NewResponse(&emptypb.Empty{}), nil
+	})
+	for n := 0; n < 3; n++ {
+		if _, err := unary(context.Background(), newSpecRequest(testUnaryProcedure)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	window := func() []*dto.Metric {
+		return gatherMetrics(t, reg, "connect_server_requests_window", map[string]string{"method": "Unary"})
+	}
+	if metrics := window(); len(metrics) != 1 || metrics[0].GetGauge().GetValue() != 3 {
+		t.Fatalf("got %v, want a series counting 3 requests", metrics)
+	}
+
+	// End the current window.
+	i.serverWindow.mu.Lock()
+	i.serverWindow.start = i.serverWindow.start.Add(-time.Hour)
+	i.serverWindow.mu.Unlock()
+
+	if metrics := window(); len(metrics) != 1 || metrics[0].GetGauge().GetValue() != 0 {
+		t.Errorf("got %v after the window ended, want a series counting 0 requests", metrics)
+	}
+}
+
+func TestStreamWithMalformedProcedure(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	var called bool
+	stream := NewInterceptor(reg).WrapStreamingHandler(func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		called = true
+		return nil
+	})
+	if err := stream(context.Background(), newSpecConn("/api/test.v1.TestService/Stream")); err != nil {
+		t.Fatalf("got error %v, want none", err)
+	}
+	if !called {
+		t.Error("handler not called")
+	}
+	if got := counterValue(t, reg, "connect_server_requests_total", nil); got != 0 {
+		t.Errorf("got %v recorded requests, want 0", got)
+	}
+}
+
+func TestNewSeparatesClientAndServer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	client, server := New(reg)
+
+	next := func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		return connect.NewResponse(&emptypb.Empty{}), nil
+	}
+	clientReq := newSpecRequest(testUnaryProcedure)
+	clientReq.spec.IsClient = true
+	serverReq := newSpecRequest(testUnaryProcedure)
+
+	for _, i := range []*Interceptor{client, server} {
+		for _, req := range []*specRequest{clientReq, serverReq} {
+			if _, err := i.WrapUnary(next)(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stream := i.WrapStreamingHandler(func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+			return nil
+		})
+		if err := stream(context.Background(), newSpecConn(testStreamProcedure)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := counterValue(t, reg, "connect_client_requests_total", nil); got != 1 {
+		t.Errorf("got %v client requests, want 1 recorded by the client interceptor", got)
+	}
+	if got := counterValue(t, reg, "connect_server_requests_total", map[string]string{"type": "unary"}); got != 1 {
+		t.Errorf("got %v unary server requests, want 1 recorded by the server interceptor", got)
+	}
+	if got := counterValue(t, reg, "connect_server_requests_total", map[string]string{"type": "bidi_stream"}); got != 1 {
+		t.Errorf("got %v server streams, want 1 recorded by the server interceptor", got)
+	}
+}
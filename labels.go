@@ -0,0 +1,113 @@
+package connectprometheus
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+)
+
+// label is an optional label added to the request metrics
+// of the client and/or server side.
+type label struct {
+	name   string
+	client bool
+	server bool
+	value  func(c *call) string
+}
+
+// call describes a single observed request.
+type call struct {
+	ctx      context.Context
+	spec     connect.Spec
+	peer     connect.Peer
+	header   http.Header
+	trailer  http.Header // nil if there's no response
+	duration time.Duration
+}
+
+// labelNames returns the names of the optional labels for a side.
+func (c *config) labelNames(client bool) []string {
+	var names []string
+	for _, l := range c.labels {
+		if (client && l.client) || (!client && l.server) {
+			names = append(names, l.name)
+		}
+	}
+	return names
+}
+
+// appendLabelValues appends the values of the optional labels
+// for the side of the call to values.
+func (c *config) appendLabelValues(values []string, cl *call) []string {
+	for _, l := range c.labels {
+		if (cl.spec.IsClient && l.client) || (!cl.spec.IsClient && l.server) {
+			values = append(values, l.value(cl))
+		}
+	}
+	return values
+}
+
+// target returns the host of the server a client call is sent to.
+func target(c *call) string {
+	if c.peer.Addr == "" {
+		return "unknown"
+	}
+	return c.peer.Addr
+}
+
+// protocol returns the RPC protocol of a call.
+func protocol(c *call) string {
+	switch c.peer.Protocol {
+	case "":
+		return "unknown"
+	case connect.ProtocolGRPCWeb:
+		return "grpc-web"
+	default:
+		return c.peer.Protocol
+	}
+}
+
+// cacheStatus returns hit, miss or none based on the value of a cache status trailer.
+func cacheStatus(value string) string {
+	switch strings.ToLower(value) {
+	case "hit":
+		return "hit"
+	case "miss":
+		return "miss"
+	default:
+		return "none"
+	}
+}
+
+// serviceVersionRegexp matches API versions in service names, like v1 in acme.foo.v1.FooService.
+var serviceVersionRegexp = regexp.MustCompile(`(?:^|\.)(v[0-9]+(?:(?:alpha|beta)[0-9]*)?)(?:\.|$)`)
+
+// serviceVersion returns the last API version in the service of a procedure,
+// or an empty string if the service name doesn't contain a version.
+func serviceVersion(procedure string) string {
+	service, _, err := splitProcedure(procedure)
+	if err != nil {
+		return ""
+	}
+	matches := serviceVersionRegexp.FindAllStringSubmatch(service, -1)
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[len(matches)-1][1]
+}
+
+// idempotency returns the idempotency level of the procedure of a call.
+func idempotency(c *call) string {
+	switch c.spec.IdempotencyLevel {
+	case connect.IdempotencyIdempotent:
+		return "idempotent"
+	case connect.IdempotencyNoSideEffects:
+		return "no_side_effects"
+	default:
+		return "unknown"
+	}
+}
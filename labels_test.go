@@ -0,0 +1,26 @@
+package connectprometheus
+
+import "testing"
+
+func TestServiceVersion(t *testing.T) {
+	tests := []struct {
+		procedure string
+		want      string
+	}{
+		{procedure: "/acme.foo.v1.FooService/Bar", want: "v1"},
+		{procedure: "/acme.foo.v2beta1.FooService/Bar", want: "v2beta1"},
+		{procedure: "/acme.foo.v1alpha.FooService/Bar", want: "v1alpha"},
+		{procedure: "/acme.foo.FooService/Bar", want: ""},
+		{procedure: "/acme.v1.foo.v2.FooService/Bar", want: "v2"},
+		{procedure: "/acme.foo.v1x.FooService/Bar", want: ""},
+		{procedure: "/acme.foov1.FooService/Bar", want: ""},
+		{procedure: "malformed", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.procedure, func(t *testing.T) {
+			if got := serviceVersion(tt.procedure); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
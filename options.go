@@ -0,0 +1,565 @@
+package connectprometheus
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// Option configures optional behaviour of an Interceptor.
+type Option func(*config)
+
+type config struct {
+	allowedMethods  map[string]struct{}
+	combinedSizes   bool
+	cpuTime         bool
+	durationBuckets []float64
+	errorCounter    bool
+	errorDetails    bool
+	expvar          bool
+	handlerTime     bool
+	labelCase       LabelCase
+	labels          []label
+	missingDeadline bool
+	nameSuffix      string
+	observers       ObserverFactory
+	outcomeLabel    bool
+	prelude         bool
+	procedurePrefix string
+	recordPredicate func(err error) bool
+	recorder        Recorder
+	rejectionCodes  map[string]struct{}
+	requestTimeout  bool
+	separateStreams bool
+	sloThresholds   map[string]time.Duration
+	streamMetrics   bool
+	strictStream    bool
+	systemServices  bool
+	window          time.Duration
+	worker          string
+}
+
+// WithDurationBuckets enables histograms tracking the duration of
+// client and server requests, using the passed buckets in seconds.
+func WithDurationBuckets(buckets []float64) Option {
+	return func(c *config) {
+		c.durationBuckets = buckets
+	}
+}
+
+// WithAllowedMethods limits the values of the method label to the passed methods,
+// for example "Bar" for the procedure "/acme.foo.v1.FooService/Bar".
+// Requests to any other method are labeled with the method other.
+// The methods are matched before applying WithLabelCase.
+// This bounds the number of series regardless of the requests received.
+func WithAllowedMethods(methods []string) Option {
+	return func(c *config) {
+		c.allowedMethods = make(map[string]struct{}, len(methods))
+		for _, method := range methods {
+			c.allowedMethods[method] = struct{}{}
+		}
+	}
+}
+
+// WithCacheStatusTrailer adds a cache label to the server metrics,
+// based on the response trailer with the passed key set by handlers.
+// The label is hit or miss if the trailer has that value, and none otherwise.
+func WithCacheStatusTrailer(key string) Option {
+	return func(c *config) {
+		c.labels = append(c.labels, label{
+			name:   "cache",
+			server: true,
+			value: func(cl *call) string {
+				return cacheStatus(cl.trailer.Get(key))
+			},
+		})
+	}
+}
+
+// WithCombinedSizeHistogram enables a single histogram tracking the size in bytes
+// of unary server request and response messages, told apart by a direction label.
+// Messages that aren't protobuf messages aren't observed.
+func WithCombinedSizeHistogram() Option {
+	return func(c *config) {
+		c.combinedSizes = true
+	}
+}
+
+// WithCPUTimeHistogram enables a histogram tracking the approximate CPU time
+// spent by unary server handlers. It uses the duration buckets if configured.
+//
+// The CPU time is measured per OS thread, so every handler is locked to its own
+// OS thread for the duration of the request, excluding other goroutines from it.
+// This has a scheduling cost: a handler blocking on I/O keeps its thread blocked
+// and the runtime has to hand off to a new thread, so every in-flight request
+// occupies one OS thread. The process crashes once the number of threads exceeds
+// the limit of runtime/debug.SetMaxThreads, 10000 by default, so only enable it
+// for servers with bounded concurrency. CPU time spent in goroutines started by
+// the handler is not included. It's only supported on Linux, on other platforms
+// the histogram isn't registered.
+func WithCPUTimeHistogram() Option {
+	return func(c *config) {
+		c.cpuTime = true
+	}
+}
+
+// WithDynamicLabel adds a label with the passed name to the client and server metrics,
+// whose value is returned by fn for every request. Unlike const labels,
+// the value can change at runtime, for example to the current deployment color.
+// Every distinct value creates new series that remain exported after the value changes,
+// so fn should only return a small, bounded set of values.
+func WithDynamicLabel(name string, fn func() string) Option {
+	return func(c *config) {
+		c.labels = append(c.labels, label{
+			name:   name,
+			client: true,
+			server: true,
+			value: func(*call) string {
+				return fn()
+			},
+		})
+	}
+}
+
+// WithErrorCounter enables a counter of failed server requests,
+// with the same labels as the server request counter.
+// It allows alerting on error rates without filtering out the ok code.
+func WithErrorCounter() Option {
+	return func(c *config) {
+		c.errorCounter = true
+	}
+}
+
+// WithErrorDetailHistogram enables a histogram tracking the size in bytes
+// of the details attached to connect errors returned by unary server handlers.
+// Errors without details aren't observed.
+func WithErrorDetailHistogram() Option {
+	return func(c *config) {
+		c.errorDetails = true
+	}
+}
+
+// WithExpvar additionally publishes the client and server request counts
+// with expvar, as the maps connect_client_requests_total and
+// connect_server_requests_total keyed by procedure and code,
+// for example "/acme.foo.v1.FooService/Bar:ok".
+func WithExpvar() Option {
+	return func(c *config) {
+		c.expvar = true
+	}
+}
+
+// durationBucketsOrDefault returns the configured duration buckets,
+// or the prometheus default buckets if none are configured.
+func (c *config) durationBucketsOrDefault() []float64 {
+	if c.durationBuckets == nil {
+		return prometheus.DefBuckets
+	}
+	return c.durationBuckets
+}
+
+// LatencyProfile is a preset of duration buckets for a class of workload.
+type LatencyProfile int
+
+const (
+	// ProfileFast suits requests completing within microseconds to milliseconds.
+	ProfileFast LatencyProfile = iota
+	// ProfileWeb suits typical web requests completing within milliseconds to seconds.
+	ProfileWeb
+	// ProfileBatch suits long-running requests completing within seconds to minutes.
+	ProfileBatch
+)
+
+// buckets returns the duration buckets in seconds for the profile.
+func (p LatencyProfile) buckets() []float64 {
+	switch p {
+	case ProfileFast:
+		return []float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1}
+	case ProfileBatch:
+		return []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+	default:
+		return []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	}
+}
+
+// WithLatencyProfile enables the request duration histograms
+// with the preset buckets of the passed LatencyProfile.
+// It is a shorthand for WithDurationBuckets.
+func WithLatencyProfile(p LatencyProfile) Option {
+	return WithDurationBuckets(p.buckets())
+}
+
+// WithTargetLabel adds a target label to the client metrics,
+// containing the host or host:port of the server a request is sent to.
+// Requests without a known server address are labeled unknown.
+func WithTargetLabel() Option {
+	return func(c *config) {
+		c.labels = append(c.labels, label{name: "target", client: true, value: target})
+	}
+}
+
+// WithHandlerTimeHistogram enables a histogram tracking the time unary server handlers
+// take until they call StampHandlerDone, excluding work after it such as serializing
+// the response. It uses the duration buckets if configured.
+// Requests whose handler doesn't call StampHandlerDone aren't observed.
+func WithHandlerTimeHistogram() Option {
+	return func(c *config) {
+		c.handlerTime = true
+	}
+}
+
+// WithHeaderLabel adds a label with the passed name to the client and server metrics,
+// containing the value of the request header with the passed key.
+// Every distinct header value creates new series, so only use it
+// for headers with a small, bounded set of values.
+func WithHeaderLabel(labelName, headerKey string) Option {
+	return func(c *config) {
+		c.labels = append(c.labels, label{
+			name:   labelName,
+			client: true,
+			server: true,
+			value: func(cl *call) string {
+				return cl.header.Get(headerKey)
+			},
+		})
+	}
+}
+
+// WithIdempotencyLabel adds an idempotency label to the client and server metrics,
+// containing the idempotency level of the procedure:
+// idempotent, no_side_effects or unknown.
+func WithIdempotencyLabel() Option {
+	return func(c *config) {
+		c.labels = append(c.labels, label{name: "idempotency", client: true, server: true, value: idempotency})
+	}
+}
+
+// LabelCase is the case of the service and method label values.
+type LabelCase int
+
+const (
+	// LabelCasePreserve keeps service and method names as they are.
+	LabelCasePreserve LabelCase = iota
+	// LabelCaseLower converts service and method names to lower case.
+	LabelCaseLower
+	// LabelCaseUpper converts service and method names to upper case.
+	LabelCaseUpper
+)
+
+// apply returns the value converted to the LabelCase.
+func (lc LabelCase) apply(value string) string {
+	switch lc {
+	case LabelCaseLower:
+		return strings.ToLower(value)
+	case LabelCaseUpper:
+		return strings.ToUpper(value)
+	default:
+		return value
+	}
+}
+
+// WithLabelCase normalizes the case of the service and method label values,
+// so names differing only in case are recorded as the same series.
+// It defaults to LabelCasePreserve.
+func WithLabelCase(lc LabelCase) Option {
+	return func(c *config) {
+		c.labelCase = lc
+	}
+}
+
+// Observer observes the duration of requests,
+// for example to aggregate them with a custom histogram implementation.
+type Observer interface {
+	ObserveDuration(seconds float64)
+}
+
+// ObserverFactory returns the Observer for requests with the passed labels.
+// It's called for every unary client and server request and must be safe for concurrent use.
+type ObserverFactory func(labels prometheus.Labels) Observer
+
+// WithMissingDeadlineCounter enables a counter of unary client requests
+// sent without a context deadline, to find code paths missing timeouts.
+func WithMissingDeadlineCounter() Option {
+	return func(c *config) {
+		c.missingDeadline = true
+	}
+}
+
+// WithNameSuffix appends the suffix to the names of all metrics, before their unit,
+// for example connect_server_requests_suffix_total. This avoids name clashes
+// with other instrumentation exporting the same metric names.
+// NewInterceptor panics if the suffix results in invalid metric names.
+func WithNameSuffix(suffix string) Option {
+	return func(c *config) {
+		c.nameSuffix = suffix
+	}
+}
+
+// metricName returns the name of a metric with its unit and the configured suffix.
+// It panics if the resulting name isn't a valid metric name.
+func (c *config) metricName(name, unit string) string {
+	if c.nameSuffix != "" {
+		name += "_" + c.nameSuffix
+	}
+	if unit != "" {
+		name += "_" + unit
+	}
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		panic(fmt.Sprintf("connectprometheus: invalid metric name %q with suffix %q", name, c.nameSuffix))
+	}
+	return name
+}
+
+// WithObserverFactory additionally passes the duration of every unary request
+// to the Observer the factory returns for the labels of the request.
+// The labels are the same as those of the request counters.
+func WithObserverFactory(factory ObserverFactory) Option {
+	return func(c *config) {
+		c.observers = factory
+	}
+}
+
+// WithOutcomeLabel adds an outcome label to the server metrics,
+// containing the outcome set by handlers with SetOutcome.
+// It's empty for requests without an outcome.
+func WithOutcomeLabel() Option {
+	return func(c *config) {
+		c.outcomeLabel = true
+		c.labels = append(c.labels, label{name: "outcome", server: true, value: outcome})
+	}
+}
+
+// WithPreludeHistogram enables histograms tracking the time spent in the
+// interceptor between receiving a unary request and passing it on to the
+// next handler in the chain. It helps diagnosing interceptor overhead.
+func WithPreludeHistogram() Option {
+	return func(c *config) {
+		c.prelude = true
+	}
+}
+
+// WithUserAgentLabel adds a user_agent label to the server metrics,
+// containing the User-Agent header of the request passed through the normalizer.
+// The normalizer must bound the number of values, for example by collapsing
+// user agents to SDK major versions. Requests without a user agent are labeled unknown.
+// NewInterceptor panics if the normalizer is nil.
+func WithUserAgentLabel(normalizer func(userAgent string) string) Option {
+	return func(c *config) {
+		if normalizer == nil {
+			panic("connectprometheus: nil user agent normalizer")
+		}
+		c.labels = append(c.labels, label{
+			name:   "user_agent",
+			server: true,
+			value: func(cl *call) string {
+				userAgent := cl.header.Get("User-Agent")
+				if userAgent == "" {
+					return "unknown"
+				}
+				return normalizer(userAgent)
+			},
+		})
+	}
+}
+
+// WithVersionFromService adds a version label to the client and server metrics,
+// containing the API version parsed from the service name,
+// for example v1 for acme.foo.v1.FooService. It's empty for unversioned services.
+func WithVersionFromService() Option {
+	return func(c *config) {
+		var versions sync.Map // procedure -> version
+		c.labels = append(c.labels, label{
+			name:   "version",
+			client: true,
+			server: true,
+			value: func(cl *call) string {
+				if version, ok := versions.Load(cl.spec.Procedure); ok {
+					return version.(string)
+				}
+				version := serviceVersion(cl.spec.Procedure)
+				versions.Store(cl.spec.Procedure, version)
+				return version
+			},
+		})
+	}
+}
+
+// WithWindowedCounter enables a connect_server_requests_window gauge
+// counting server requests within the current window of the passed duration,
+// with the same labels as the server request counter. The counts reset to zero
+// whenever a new window starts.
+//
+// This isn't idiomatic for prometheus, where rate() over the request counter
+// should be preferred. It's meant for environments without rate().
+func WithWindowedCounter(window time.Duration) Option {
+	return func(c *config) {
+		c.window = window
+	}
+}
+
+// WithWorkerLabel adds a worker const label with the passed id to all metrics.
+// In servers running multiple worker processes, each with its own registry,
+// a stable id per worker allows aggregating their metrics correctly,
+// and restarted workers don't look like counter resets of other workers.
+func WithWorkerLabel(id string) Option {
+	return func(c *config) {
+		c.worker = id
+	}
+}
+
+// WithProcedurePrefixTrim strips the leading path segment prefix from procedures,
+// for example /api for gateways rewriting procedures to /api/acme.foo.v1.FooService/Bar.
+// Procedures without the prefix are left as they are.
+func WithProcedurePrefixTrim(prefix string) Option {
+	return func(c *config) {
+		if prefix = strings.Trim(prefix, "/"); prefix != "" {
+			c.procedurePrefix = "/" + prefix
+		}
+	}
+}
+
+// trimProcedure returns the procedure without the configured prefix.
+func (c *config) trimProcedure(procedure string) string {
+	if c.procedurePrefix == "" || !strings.HasPrefix(procedure, c.procedurePrefix+"/") {
+		return procedure
+	}
+	return procedure[len(c.procedurePrefix):]
+}
+
+// WithProtocolLabel adds a protocol label to the client and server metrics,
+// containing the RPC protocol of a request: connect, grpc or grpc-web.
+// This allows telling gRPC-Web traffic apart from native connect traffic.
+func WithProtocolLabel() Option {
+	return func(c *config) {
+		c.labels = append(c.labels, label{name: "protocol", client: true, server: true, value: protocol})
+	}
+}
+
+// WithRecorder records the request counts and durations with the passed Recorder,
+// instead of the default prometheus request counters and duration histograms.
+// All other metrics are still recorded with prometheus.
+func WithRecorder(r Recorder) Option {
+	return func(c *config) {
+		c.recorder = r
+	}
+}
+
+// WithRecordPredicate only records requests for which the predicate,
+// called with the error returned by the request, returns true.
+// For example, returning err != nil only records failed requests.
+// To only apply it to some methods, pass an interceptor with the predicate
+// to the handlers of these methods.
+func WithRecordPredicate(predicate func(err error) bool) Option {
+	return func(c *config) {
+		c.recordPredicate = predicate
+	}
+}
+
+// WithRejectionCodes enables a counter of server requests failing with
+// one of the passed codes, for example connect.CodeResourceExhausted returned by
+// a concurrency limiter. It allows alerting on rejections separately from other errors.
+func WithRejectionCodes(codes []connect.Code) Option {
+	return func(c *config) {
+		c.rejectionCodes = make(map[string]struct{}, len(codes))
+		for _, code := range codes {
+			c.rejectionCodes[code.String()] = struct{}{}
+		}
+	}
+}
+
+// WithSeparateStreamMetrics counts unary and streaming server requests
+// in the separate connect_server_unary_requests_total and
+// connect_server_stream_requests_total counters, instead of
+// connect_server_requests_total. This avoids accidentally aggregating
+// the requests of fundamentally different workloads.
+func WithSeparateStreamMetrics() Option {
+	return func(c *config) {
+		c.separateStreams = true
+	}
+}
+
+// WithRequestedTimeoutHistogram enables a histogram tracking the timeouts
+// clients declare with the Connect-Timeout-Ms header of unary server requests.
+// Requests without a valid header aren't observed.
+func WithRequestedTimeoutHistogram() Option {
+	return func(c *config) {
+		c.requestTimeout = true
+	}
+}
+
+// WithSLOThreshold enables a counter of unary server requests
+// taking longer than the latency threshold of their procedure.
+// The thresholds are keyed by procedure, for example "/acme.foo.v1.FooService/Bar".
+// The threshold keyed by "*" is used for procedures not in the map,
+// without it these procedures are never counted as violations.
+func WithSLOThreshold(thresholds map[string]time.Duration) Option {
+	return func(c *config) {
+		c.sloThresholds = make(map[string]time.Duration, len(thresholds))
+		for procedure, threshold := range thresholds {
+			c.sloThresholds[procedure] = threshold
+		}
+	}
+}
+
+// sloThreshold returns the latency threshold of a procedure.
+func (c *config) sloThreshold(procedure string) (time.Duration, bool) {
+	if threshold, ok := c.sloThresholds[procedure]; ok {
+		return threshold, true
+	}
+	threshold, ok := c.sloThresholds["*"]
+	return threshold, ok
+}
+
+// WithSlowThreshold adds a slow label to the client and server metrics,
+// which is true for requests taking longer than the threshold and false otherwise.
+// It allows graphing the fraction of slow requests without computing quantiles.
+func WithSlowThreshold(threshold time.Duration) Option {
+	return func(c *config) {
+		c.labels = append(c.labels, label{
+			name:   "slow",
+			client: true,
+			server: true,
+			value: func(cl *call) string {
+				return strconv.FormatBool(cl.duration > threshold)
+			},
+		})
+	}
+}
+
+// WithStreamMetrics enables metrics for streaming server handlers,
+// such as the number and size of messages sent and received per stream,
+// told apart by a direction label of request or response like WithCombinedSizeHistogram,
+// the interval between consecutively sent messages,
+// the time until the first message is received by client and bidi streams,
+// the number of in-progress sends and receives
+// and the number of streams failing at open or while streaming.
+func WithStreamMetrics() Option {
+	return func(c *config) {
+		c.streamMetrics = true
+	}
+}
+
+// WithStrictStreamType counts requests with a stream type unknown to this package,
+// for example one added by a newer connect version, as interceptor errors.
+// Such requests are recorded with the type unknown either way,
+// this allows alerting on the version drift.
+func WithStrictStreamType() Option {
+	return func(c *config) {
+		c.strictStream = true
+	}
+}
+
+// WithSystemServiceMetric records unary and streaming server requests to the
+// gRPC reflection and health services in a separate connect_system_requests_total
+// counter, instead of the metrics of the other services.
+func WithSystemServiceMetric() Option {
+	return func(c *config) {
+		c.systemServices = true
+	}
+}
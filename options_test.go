@@ -0,0 +1,28 @@
+package connectprometheus
+
+import "testing"
+
+func TestWithProcedurePrefixTrim(t *testing.T) {
+	tests := []struct {
+		name      string
+		prefix    string
+		procedure string
+		want      string
+	}{
+		{name: "prefix without slashes", prefix: "api", procedure: "/api/acme.foo.v1.FooService/Bar", want: "/acme.foo.v1.FooService/Bar"},
+		{name: "prefix with slashes", prefix: "/api/", procedure: "/api/acme.foo.v1.FooService/Bar", want: "/acme.foo.v1.FooService/Bar"},
+		{name: "nested prefix", prefix: "/gateway/api", procedure: "/gateway/api/acme.foo.v1.FooService/Bar", want: "/acme.foo.v1.FooService/Bar"},
+		{name: "procedure without prefix", prefix: "api", procedure: "/acme.foo.v1.FooService/Bar", want: "/acme.foo.v1.FooService/Bar"},
+		{name: "look-alike prefix", prefix: "api", procedure: "/apix/acme.foo.v1.FooService/Bar", want: "/apix/acme.foo.v1.FooService/Bar"},
+		{name: "empty prefix", prefix: "/", procedure: "/api/acme.foo.v1.FooService/Bar", want: "/api/acme.foo.v1.FooService/Bar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c config
+			WithProcedurePrefixTrim(tt.prefix)(&c)
+			if got := c.trimProcedure(tt.procedure); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
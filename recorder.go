@@ -0,0 +1,106 @@
+package connectprometheus
+
+import (
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Labels are the label names and values of a request, in the same order.
+// The names start with code, method, service and type,
+// followed by the names of the optional labels.
+type Labels struct {
+	Names  []string
+	Values []string
+}
+
+// Recorder records the requests observed by an Interceptor to a metrics backend.
+// The default Recorder records them with prometheus, other implementations allow
+// recording them with a different backend, for example OpenTelemetry metrics.
+// Implementations must be safe for concurrent use.
+type Recorder interface {
+	// IncRequest increments the number of requests with the labels.
+	// It's called for unary requests and server streams.
+	IncRequest(spec connect.Spec, labels Labels)
+	// ObserveDuration observes the duration of a unary request with the labels.
+	ObserveDuration(spec connect.Spec, labels Labels, d time.Duration)
+}
+
+// prometheusRecorder is the default Recorder recording requests with prometheus.
+type prometheusRecorder struct {
+	clientRequests       *prometheus.CounterVec
+	serverRequests       *prometheus.CounterVec
+	serverStreamRequests *prometheus.CounterVec
+
+	// The duration histograms are nil unless duration buckets are configured.
+	clientDuration *prometheus.HistogramVec
+	serverDuration *prometheus.HistogramVec
+}
+
+// newPrometheusRecorder creates a prometheusRecorder
+// that registers metrics with the passed prometheus.Registerer.
+func (c *collectors) newPrometheusRecorder(reg prometheus.Registerer) *prometheusRecorder {
+	r := &prometheusRecorder{}
+
+	r.clientRequests = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: c.metricName("connect_client_requests", "total"),
+		Help: "Tracks the number of connect client requests by code, method, service and type.",
+	}, c.clientLabels)
+
+	if c.config.separateStreams {
+		r.serverRequests = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: c.metricName("connect_server_unary_requests", "total"),
+			Help: "Tracks the number of unary connect server requests by code, method, service and type.",
+		}, c.serverLabels)
+
+		r.serverStreamRequests = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: c.metricName("connect_server_stream_requests", "total"),
+			Help: "Tracks the number of streaming connect server requests by code, method, service and type.",
+		}, c.serverLabels)
+	} else {
+		r.serverRequests = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: c.metricName("connect_server_requests", "total"),
+			Help: "Tracks the number of connect server requests by code, method, service and type.",
+		}, c.serverLabels)
+		r.serverStreamRequests = r.serverRequests
+	}
+
+	if c.config.durationBuckets != nil {
+		r.clientDuration = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    c.metricName("connect_client_handling", "seconds"),
+			Help:    "Tracks the duration of connect client requests by code, method, service and type.",
+			Buckets: c.config.durationBuckets,
+		}, c.clientLabels)
+
+		r.serverDuration = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    c.metricName("connect_server_handling", "seconds"),
+			Help:    "Tracks the duration of connect server requests by code, method, service and type.",
+			Buckets: c.config.durationBuckets,
+		}, c.serverLabels)
+	}
+
+	return r
+}
+
+func (r *prometheusRecorder) IncRequest(spec connect.Spec, labels Labels) {
+	switch {
+	case spec.IsClient:
+		r.clientRequests.WithLabelValues(labels.Values...).Inc()
+	case spec.StreamType == connect.StreamTypeUnary:
+		r.serverRequests.WithLabelValues(labels.Values...).Inc()
+	default:
+		r.serverStreamRequests.WithLabelValues(labels.Values...).Inc()
+	}
+}
+
+func (r *prometheusRecorder) ObserveDuration(spec connect.Spec, labels Labels, d time.Duration) {
+	duration := r.serverDuration
+	if spec.IsClient {
+		duration = r.clientDuration
+	}
+	if duration != nil {
+		duration.WithLabelValues(labels.Values...).Observe(d.Seconds())
+	}
+}
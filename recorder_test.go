@@ -0,0 +1,88 @@
+package connectprometheus
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// recorderCall is a call of a fakeRecorder method.
+type recorderCall struct {
+	method string
+	spec   connect.Spec
+	labels Labels
+}
+
+// fakeRecorder is a Recorder remembering its calls.
+type fakeRecorder struct {
+	mu    sync.Mutex
+	calls []recorderCall
+}
+
+func (r *fakeRecorder) IncRequest(spec connect.Spec, labels Labels) {
+	r.record("IncRequest", spec, labels)
+}
+
+func (r *fakeRecorder) ObserveDuration(spec connect.Spec, labels Labels, d time.Duration) {
+	r.record("ObserveDuration", spec, labels)
+}
+
+func (r *fakeRecorder) record(method string, spec connect.Spec, labels Labels) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = append(r.calls, recorderCall{method: method, spec: spec, labels: labels})
+}
+
+func TestWithRecorder(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	recorder := &fakeRecorder{}
+	i := NewInterceptor(reg, WithRecorder(recorder), WithDynamicLabel("color", func() string { return "blue" }))
+
+	next := func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		return connect.NewResponse(&emptypb.Empty{}), nil
+	}
+	clientReq := newSpecRequest(testUnaryProcedure)
+	clientReq.spec.IsClient = true
+	serverReq := newSpecRequest(testUnaryProcedure)
+	conn := newSpecConn(testStreamProcedure)
+
+	for _, req := range []*specRequest{clientReq, serverReq} {
+		if _, err := i.WrapUnary(next)(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream := i.WrapStreamingHandler(func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		return nil
+	})
+	if err := stream(context.Background(), conn); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"code", "method", "service", "type", "color"}
+	unaryLabels := Labels{Names: names, Values: []string{"ok", "Unary", "test.v1.TestService", "unary", "blue"}}
+	streamLabels := Labels{Names: names, Values: []string{"ok", "Stream", "test.v1.TestService", "bidi_stream", "blue"}}
+	want := []recorderCall{
+		{method: "IncRequest", spec: clientReq.spec, labels: unaryLabels},
+		{method: "ObserveDuration", spec: clientReq.spec, labels: unaryLabels},
+		{method: "IncRequest", spec: serverReq.spec, labels: unaryLabels},
+		{method: "ObserveDuration", spec: serverReq.spec, labels: unaryLabels},
+		{method: "IncRequest", spec: conn.spec, labels: streamLabels},
+	}
+	if !reflect.DeepEqual(recorder.calls, want) {
+		t.Errorf("got calls %+v, want %+v", recorder.calls, want)
+	}
+
+	// The prometheus request counters aren't registered, so registering them again succeeds.
+	for _, name := range []string{"connect_client_requests_total", "connect_server_requests_total"} {
+		if err := reg.Register(prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: "Test counter."})); err != nil {
+			t.Errorf("registering %s: %v", name, err)
+		}
+	}
+}
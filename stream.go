@@ -0,0 +1,74 @@
+package connectprometheus
+
+import (
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// handlerConn wraps a connect.StreamingHandlerConn
+// to track the messages flowing through the stream.
+type handlerConn struct {
+	connect.StreamingHandlerConn
+
+	opened          time.Time
+	sendInterval    prometheus.Observer
+	firstReceive    prometheus.Observer // nil unless the client streams messages
+	pendingSends    prometheus.Gauge
+	pendingReceives prometheus.Gauge
+
+	messageSize  func(msg any) (int, bool)
+	sentSize     prometheus.Observer
+	receivedSize prometheus.Observer
+
+	sent     int
+	received int
+	lastSend time.Time
+}
+
+func (c *handlerConn) Send(msg any) error {
+	if err := c.send(msg); err != nil {
+		return err
+	}
+	c.sent++
+	if size, ok := c.messageSize(msg); ok {
+		c.sentSize.Observe(float64(size))
+	}
+
+	now := time.Now()
+	if !c.lastSend.IsZero() {
+		c.sendInterval.Observe(now.Sub(c.lastSend).Seconds())
+	}
+	c.lastSend = now
+
+	return nil
+}
+
+func (c *handlerConn) Receive(msg any) error {
+	if err := c.receive(msg); err != nil {
+		return err
+	}
+	if c.received == 0 && c.firstReceive != nil {
+		c.firstReceive.Observe(time.Since(c.opened).Seconds())
+	}
+	c.received++
+	if size, ok := c.messageSize(msg); ok {
+		c.receivedSize.Observe(float64(size))
+	}
+	return nil
+}
+
+// send sends the message, tracking it as pending until the send returns or panics.
+func (c *handlerConn) send(msg any) error {
+	c.pendingSends.Inc()
+	defer c.pendingSends.Dec()
+	return c.StreamingHandlerConn.Send(msg)
+}
+
+// receive receives the message, tracking it as pending until the receive returns or panics.
+func (c *handlerConn) receive(msg any) error {
+	c.pendingReceives.Inc()
+	defer c.pendingReceives.Dec()
+	return c.StreamingHandlerConn.Receive(msg)
+}
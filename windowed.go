@@ -0,0 +1,78 @@
+package connectprometheus
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// windowedCounter is a prometheus.Collector exporting counts of the current
+// time window as gauges, which are reset to zero when a new window starts.
+type windowedCounter struct {
+	desc   *prometheus.Desc
+	window time.Duration
+
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]*windowedCount
+}
+
+type windowedCount struct {
+	labelValues []string
+	value       float64
+}
+
+func newWindowedCounter(name, help string, labelNames []string, window time.Duration) *windowedCounter {
+	return &windowedCounter{
+		desc:   prometheus.NewDesc(name, help, labelNames, nil),
+		window: window,
+		start:  time.Now().Truncate(window),
+		counts: map[string]*windowedCount{},
+	}
+}
+
+// Inc increments the count of the label values in the current window.
+func (c *windowedCounter) Inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.roll(time.Now())
+
+	key := strings.Join(labelValues, "\xff")
+	count, ok := c.counts[key]
+	if !ok {
+		count = &windowedCount{labelValues: append([]string(nil), labelValues...)}
+		c.counts[key] = count
+	}
+	count.value++
+}
+
+func (c *windowedCounter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *windowedCounter) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.roll(time.Now())
+
+	for _, count := range c.counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, count.value, count.labelValues...)
+	}
+}
+
+// roll resets all counts to zero if the current window has ended.
+// Series are kept, so they report zero instead of disappearing.
+// It must be called with c.mu held.
+func (c *windowedCounter) roll(now time.Time) {
+	if now.Sub(c.start) < c.window {
+		return
+	}
+	c.start = now.Truncate(c.window)
+	for _, count := range c.counts {
+		count.value = 0
+	}
+}